@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/cblomart/vsphere-graphite/logger"
+)
+
+var log = logger.New("backend")
+
+// Point : a single metric datapoint collected from vsphere and ready to be
+// shipped to a backend.
+type Point struct {
+	VCenter    string
+	ObjectType string
+	ObjectName string
+	Datacenter string
+	Cluster    string
+	Host       string
+	Group      string
+	Counter    string
+	Instance   string
+	Rollup     string
+	Value      int64
+	Timestamp  int64
+}
+
+// Backend : common interface implemented by every metric backend
+// (graphite, influxdb, ...).
+type Backend interface {
+	// Init connects and prepares the backend to receive points.
+	Init() error
+	// SendMetrics ships a batch of points to the backend, returning the
+	// last error encountered, if any.
+	SendMetrics(points []Point) error
+	// Disconnect releases any resource held by the backend.
+	Disconnect()
+}
+
+// Config : backend settings common to all implementations. It is filled
+// from the configuration file, environment variables and, ultimately,
+// used to build the concrete Backend selected by Type.
+type Config struct {
+	Type            string
+	Hostname        string
+	Port            int
+	Username        string
+	Password        string
+	Database        string
+	RetentionPolicy string
+	Prefix          string
+}
+
+// NewBackend builds the concrete Backend implementation matching
+// config.Type, defaulting to graphite when Type is empty for backward
+// compatibility with existing configurations.
+func NewBackend(config Config) (Backend, error) {
+	switch config.Type {
+	case "", "graphite":
+		return &Graphite{Config: config}, nil
+	case "influxdb":
+		return &InfluxDB{Config: config}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend type: %s", config.Type)
+	}
+}
@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Graphite : sends points to a graphite carbon endpoint using the plain
+// text protocol.
+type Graphite struct {
+	Config
+	conn net.Conn
+}
+
+// Init opens the TCP connection to the carbon endpoint.
+func (graphite *Graphite) Init() error {
+	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", graphite.Hostname, graphite.Port))
+	if err != nil {
+		return err
+	}
+	graphite.conn = conn
+	return nil
+}
+
+// SendMetrics writes every point as a "path value timestamp" line,
+// returning the last write error encountered, if any.
+func (graphite *Graphite) SendMetrics(points []Point) error {
+	var sendErr error
+	for _, point := range points {
+		if point.Counter == "" {
+			continue
+		}
+		path := graphite.metricPath(point)
+		line := fmt.Sprintf("%s %d %d\n", path, point.Value, point.Timestamp)
+		_, err := graphite.conn.Write([]byte(line))
+		if err != nil {
+			log.Error("could not send metric to graphite: %s", err)
+			sendErr = err
+		}
+	}
+	return sendErr
+}
+
+// Disconnect closes the carbon connection.
+func (graphite *Graphite) Disconnect() {
+	if graphite.conn != nil {
+		graphite.conn.Close()
+	}
+}
+
+func (graphite *Graphite) metricPath(point Point) string {
+	parts := []string{point.VCenter, point.Datacenter, point.Cluster, point.Host, point.ObjectName, point.Group, point.Counter, point.Rollup, point.Instance}
+	kept := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	path := strings.Join(kept, ".")
+	if graphite.Prefix != "" {
+		path = graphite.Prefix + "." + path
+	}
+	return path
+}
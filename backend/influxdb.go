@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+)
+
+// InfluxDB : sends points to an InfluxDB v1 server using the line
+// protocol. The counter name becomes the measurement, the metric value
+// becomes the "value" field and the point's vcenter, datacenter, cluster,
+// host, object name, instance and rollup, when set, are added as tags.
+type InfluxDB struct {
+	Config
+	client influx.Client
+}
+
+// Init opens the HTTP client used to write points to InfluxDB.
+func (idb *InfluxDB) Init() error {
+	client, err := influx.NewHTTPClient(influx.HTTPConfig{
+		Addr:     fmt.Sprintf("http://%s:%d", idb.Hostname, idb.Port),
+		Username: idb.Username,
+		Password: idb.Password,
+	})
+	if err != nil {
+		return err
+	}
+	idb.client = client
+	return nil
+}
+
+// SendMetrics writes the given points as a single batch, retrying once on
+// any write error and returning the final error, if any.
+func (idb *InfluxDB) SendMetrics(points []Point) error {
+	batch, err := influx.NewBatchPoints(influx.BatchPointsConfig{
+		Database:        idb.Database,
+		RetentionPolicy: idb.RetentionPolicy,
+		Precision:       "s",
+	})
+	if err != nil {
+		log.Error("could not create influxdb batch: %s", err)
+		return err
+	}
+	for _, point := range points {
+		if point.Counter == "" {
+			continue
+		}
+		tags := map[string]string{}
+		if point.VCenter != "" {
+			tags["vcenter"] = point.VCenter
+		}
+		if point.Datacenter != "" {
+			tags["datacenter"] = point.Datacenter
+		}
+		if point.Cluster != "" {
+			tags["cluster"] = point.Cluster
+		}
+		if point.Host != "" {
+			tags["host"] = point.Host
+		}
+		if point.ObjectName != "" {
+			tags["name"] = point.ObjectName
+		}
+		if point.Instance != "" {
+			tags["instance"] = point.Instance
+		}
+		if point.Rollup != "" {
+			tags["rollup"] = point.Rollup
+		}
+		fields := map[string]interface{}{"value": point.Value}
+		pt, err := influx.NewPoint(point.Counter, tags, fields, time.Unix(point.Timestamp, 0))
+		if err != nil {
+			log.Error("could not create influxdb point: %s", err)
+			continue
+		}
+		batch.AddPoint(pt)
+	}
+	if err := idb.write(batch); err != nil {
+		log.Warning("retrying influxdb write after error: %s", err)
+		if err := idb.write(batch); err != nil {
+			log.Error("could not send metrics to influxdb: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (idb *InfluxDB) write(batch influx.BatchPoints) error {
+	return idb.client.Write(batch)
+}
+
+// Disconnect closes the InfluxDB HTTP client.
+func (idb *InfluxDB) Disconnect() {
+	if idb.client != nil {
+		idb.client.Close()
+	}
+}
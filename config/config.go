@@ -0,0 +1,163 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cblomart/vsphere-graphite/backend"
+	"github.com/cblomart/vsphere-graphite/logger"
+	"github.com/cblomart/vsphere-graphite/vsphere"
+)
+
+var log = logger.New("config")
+
+// Configuration : top level structure decoded from the JSON configuration
+// file.
+type Configuration struct {
+	VCenters   []*vsphere.VCenter
+	Metrics    []vsphere.MetricDef
+	Interval   int
+	Domain     string
+	FlushSize  int
+	Profiling  bool
+	LogLevel   string
+	LogFormat  string
+	HTTPListen string
+	Backend    Backend
+}
+
+// Backend : backend settings from the configuration file. Its exported
+// fields are also overridable through BACKEND_* environment variables,
+// see ApplyEnvOverrides.
+type Backend struct {
+	Type            string
+	Hostname        string
+	Port            int
+	Username        string
+	Password        string
+	Database        string
+	RetentionPolicy string
+	Prefix          string
+	handler         backend.Backend
+}
+
+// Init builds and connects the concrete backend matching Type.
+func (b *Backend) Init() error {
+	handler, err := backend.NewBackend(backend.Config{
+		Type:            b.Type,
+		Hostname:        b.Hostname,
+		Port:            b.Port,
+		Username:        b.Username,
+		Password:        b.Password,
+		Database:        b.Database,
+		RetentionPolicy: b.RetentionPolicy,
+		Prefix:          b.Prefix,
+	})
+	if err != nil {
+		return err
+	}
+	if err := handler.Init(); err != nil {
+		return err
+	}
+	b.handler = handler
+	return nil
+}
+
+// SendMetrics forwards a batch of points to the underlying backend.
+func (b *Backend) SendMetrics(points []backend.Point) error {
+	return b.handler.SendMetrics(points)
+}
+
+// Disconnect releases the underlying backend.
+func (b *Backend) Disconnect() {
+	b.handler.Disconnect()
+}
+
+// Load reads and decodes the JSON configuration file at path, applying
+// the same defaults as a fresh startup.
+func Load(path string) (Configuration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Configuration{}, err
+	}
+	defer file.Close()
+	c := Configuration{}
+	if err := json.NewDecoder(file).Decode(&c); err != nil {
+		return Configuration{}, err
+	}
+	if c.FlushSize == 0 {
+		c.FlushSize = 1000
+	}
+	return c, nil
+}
+
+// ApplyEnvOverrides overrides the exported string and int fields of dst
+// with environment variables named "<TypeName>_<FieldName>" in upper
+// case, e.g. BACKEND_HOSTNAME for Backend.Hostname or
+// CONFIGURATION_INTERVAL for Configuration.Interval. dst must be a
+// pointer to a struct.
+func ApplyEnvOverrides(dst interface{}) {
+	s := reflect.ValueOf(dst).Elem()
+	numfields := s.NumField()
+	for i := 0; i < numfields; i++ {
+		f := s.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		envname := strings.ToUpper(s.Type().Name() + "_" + s.Type().Field(i).Name)
+		envval := os.Getenv(envname)
+		if len(envval) == 0 {
+			continue
+		}
+		switch f.Type().Name() {
+		case "string":
+			f.SetString(envval)
+		case "int":
+			val, err := strconv.ParseInt(envval, 10, 64)
+			if err == nil {
+				f.SetInt(val)
+			}
+		}
+	}
+}
+
+// Reload re-reads the configuration file at path and hot-swaps the
+// fields that can safely change without restarting the daemon (Metrics,
+// Interval, FlushSize and the vCenter list). If the Backend section
+// changed, the new backend is initialized first and the previous one is
+// only disconnected and replaced once that succeeds: c.Backend must
+// never be overwritten by the freshly decoded, un-initialized value
+// returned by Load, since its unexported handler is still nil and a
+// later SendMetrics/Disconnect on it would panic. It reports whether the
+// backend was swapped in.
+func (c *Configuration) Reload(path string) (bool, error) {
+	newConfig, err := Load(path)
+	if err != nil {
+		return false, err
+	}
+	c.Metrics = newConfig.Metrics
+	c.Interval = newConfig.Interval
+	c.FlushSize = newConfig.FlushSize
+	c.VCenters = newConfig.VCenters
+	backendChanged := newConfig.Backend.Type != c.Backend.Type ||
+		newConfig.Backend.Hostname != c.Backend.Hostname ||
+		newConfig.Backend.Port != c.Backend.Port ||
+		newConfig.Backend.Username != c.Backend.Username ||
+		newConfig.Backend.Password != c.Backend.Password ||
+		newConfig.Backend.Database != c.Backend.Database ||
+		newConfig.Backend.RetentionPolicy != c.Backend.RetentionPolicy ||
+		newConfig.Backend.Prefix != c.Backend.Prefix
+	if !backendChanged {
+		return false, nil
+	}
+	if err := newConfig.Backend.Init(); err != nil {
+		log.Error("could not initialize reloaded backend, keeping previous one: %s", err)
+		return false, nil
+	}
+	c.Backend.Disconnect()
+	c.Backend = newConfig.Backend
+	return true, nil
+}
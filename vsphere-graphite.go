@@ -1,23 +1,26 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"expvar"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path"
-	"reflect"
 	"runtime"
 	"runtime/pprof"
-	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cblomart/vsphere-graphite/backend"
 	"github.com/cblomart/vsphere-graphite/config"
+	"github.com/cblomart/vsphere-graphite/logger"
 	"github.com/cblomart/vsphere-graphite/vsphere"
 
 	"github.com/takama/daemon"
@@ -27,6 +30,30 @@ import (
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+const (
+	// duration the debug level stays forced after a SIGUSR1
+	debugBurst = 60 * time.Second
+	// maximum time a graceful shutdown waits for the buffer to flush
+	drainTimeout = 10 * time.Second
+)
+
+// version is set through a linker flag at build time (-X main.version=...)
+var version = "dev"
+
+// expvar variables published on /debug/vars when config.HTTPListen is set
+var (
+	varVersion        = expvar.NewString("version")
+	varStartTime      = expvar.NewString("start_time")
+	varQueryCount     = expvar.NewMap("vcenter_query_count")
+	varQueryErrors    = expvar.NewMap("vcenter_query_errors")
+	varQueryDuration  = expvar.NewMap("vcenter_query_duration_ms")
+	varSendCount      = expvar.NewInt("backend_send_count")
+	varSendErrors     = expvar.NewInt("backend_send_errors")
+	varBufferFill     = expvar.NewInt("buffer_fill")
+	varDroppedPoints  = expvar.NewInt("dropped_points")
+	varLastFlushEpoch = expvar.NewInt("last_flush_epoch")
+)
+
 const (
 	// name of the service
 	name        = "vsphere-graphite"
@@ -35,7 +62,7 @@ const (
 
 var dependencies = []string{}
 
-var stdlog, errlog *log.Logger
+var log = logger.New("main")
 
 // Service has embedded daemon
 type Service struct {
@@ -49,179 +76,370 @@ type EntityQuery struct {
 	Metrics []int
 }
 
-func queryVCenter(vcenter vsphere.VCenter, config config.Configuration, channel *chan backend.Point) {
-	vcenter.Query(config.Interval, config.Domain, channel)
+// vcenterList collects repeated --vcenter flag values, each in
+// "user:pass@host" form.
+type vcenterList []string
+
+func (v *vcenterList) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *vcenterList) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// VCenters parses every collected flag value into a vsphere.VCenter.
+func (v *vcenterList) VCenters() ([]*vsphere.VCenter, error) {
+	vcenters := make([]*vsphere.VCenter, 0, len(*v))
+	for _, entry := range *v {
+		at := strings.LastIndex(entry, "@")
+		if at < 0 {
+			return nil, fmt.Errorf("invalid --vcenter value %q, want user:pass@host", entry)
+		}
+		userpass, host := entry[:at], entry[at+1:]
+		colon := strings.Index(userpass, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid --vcenter value %q, want user:pass@host", entry)
+		}
+		vcenters = append(vcenters, &vsphere.VCenter{
+			Username: userpass[:colon],
+			Password: userpass[colon+1:],
+			Hostname: host,
+		})
+	}
+	return vcenters, nil
+}
+
+func queryVCenter(ctx context.Context, vcenter vsphere.VCenter, config config.Configuration, channel *chan backend.Point) {
+	start := time.Now()
+	err := vcenter.Query(ctx, config.Interval, config.Domain, channel)
+	varQueryCount.Add(vcenter.Hostname, 1)
+	varQueryDuration.Add(vcenter.Hostname, time.Since(start).Nanoseconds()/int64(time.Millisecond))
+	if err != nil {
+		varQueryErrors.Add(vcenter.Hostname, 1)
+		log.Error("query of vcenter %s failed: %s", vcenter.Hostname, err)
+	}
+}
+
+// drain performs a bounded, cancellable shutdown: in-flight queries are
+// cancelled via ctx, the partial buffer is flushed with a timeout, and
+// the backend is disconnected. A second signal received while draining
+// aborts the flush, dumps every goroutine stack for diagnosis, and exits
+// immediately, so a daemon stuck mid shutdown can always be killed with
+// one more Ctrl-C/SIGTERM.
+//
+// This intentionally collapses what was originally envisioned as two
+// escalation tiers (a calm "abort the flush" on the second signal, a
+// diagnostic "dump and force exit" only on a third) into one: an
+// operator repeating a signal wants the daemon dead now, and since the
+// process is exiting either way the goroutine dump costs nothing extra,
+// so the second signal already carries everything a notional third
+// signal would add.
+func drain(cfg *config.Configuration, cancel context.CancelFunc, pointbuffer []backend.Point, bufferindex int, interrupt chan os.Signal) (string, error) {
+	log.Info("Starting graceful shutdown")
+	cancel()
+
+	flushed := make(chan struct{})
+	go func() {
+		if bufferindex > 0 {
+			if err := cfg.Backend.SendMetrics(pointbuffer[:bufferindex]); err != nil {
+				varSendErrors.Add(1)
+				log.Error("could not send metrics to backend during drain: %s", err)
+			} else {
+				log.Info("Sent %d logs to backend during drain", bufferindex)
+			}
+			varSendCount.Add(1)
+			varLastFlushEpoch.Set(time.Now().Unix())
+		}
+		cfg.Backend.Disconnect()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return "Daemon was stopped gracefully", nil
+	case <-time.After(drainTimeout):
+		log.Warning("Drain timed out after %s, exiting without a full flush", drainTimeout)
+		return "Daemon drain timed out", nil
+	case sig := <-interrupt:
+		log.Error("Got second signal (%v) during drain, aborting flush and dumping goroutines before forced exit", sig)
+		buf := make([]byte, 1<<20)
+		n := runtime.Stack(buf, true)
+		fmt.Fprintf(os.Stderr, "%s\n", buf[:n])
+		os.Exit(1)
+		return "", nil
+	}
+}
+
+// watchDebugSignal bumps the global log level to debug for debugBurst
+// every time SIGUSR1 is received, then reverts to the level in effect
+// before the first signal of the burst, so verbose traces can be
+// captured without a restart. A signal received while a burst is
+// already in progress only extends the deadline: it neither re-captures
+// "previous" (which would otherwise be DEBUG) nor stacks a second
+// independent revert timer.
+func watchDebugSignal() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	var (
+		mu      sync.Mutex
+		timer   *time.Timer
+		prior   logger.Level
+		inBurst bool
+	)
+	for range usr1 {
+		mu.Lock()
+		if !inBurst {
+			prior = logger.GetLevel()
+			logger.SetLevel(logger.DEBUG)
+			inBurst = true
+			log.Info("SIGUSR1 received: forcing debug logging for %s", debugBurst)
+		} else {
+			log.Info("SIGUSR1 received: extending debug logging burst by %s", debugBurst)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(debugBurst, func() {
+			mu.Lock()
+			logger.SetLevel(prior)
+			inBurst = false
+			mu.Unlock()
+			log.Info("debug logging burst over, reverting to previous level")
+		})
+		mu.Unlock()
+	}
 }
 
 // Manage by daemon commands or run the daemon
 func (service *Service) Manage() (string, error) {
 
-	usage := "Usage: vsphere-graphite install | remove | start | stop | status"
+	usage := "Usage: vsphere-graphite [install | remove | start | stop | status] [flags]"
+
+	// the daemon subcommand, if any, is always the first positional
+	// argument; every flag is parsed from what follows it
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPathFlag := flags.String("config", "/etc/"+name+".json", "path to the JSON configuration file")
+	intervalFlag := flags.Int("interval", 0, "collection interval in seconds")
+	flushSizeFlag := flags.Int("flush-size", 0, "number of points buffered before a flush")
+	logLevelFlag := flags.String("log-level", "", "log level: debug, info, warning, error")
+	httpListenFlag := flags.String("http-listen", "", "address to serve expvar/pprof on, e.g. :9155")
+	var vcenterFlags vcenterList
+	flags.Var(&vcenterFlags, "vcenter", "vcenter as user:pass@host, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return "Could not parse flags", err
+	}
 
 	// if received any kind of command, do it
-	if len(os.Args) > 1 {
-		command := os.Args[1]
-		switch command {
-		case "install":
-			return service.Install()
-		case "remove":
-			return service.Remove()
-		case "start":
-			return service.Start()
-		case "stop":
-			return service.Stop()
-		case "status":
-			return service.Status()
-		default:
-			return usage, nil
-		}
+	switch command {
+	case "install":
+		return service.Install()
+	case "remove":
+		return service.Remove()
+	case "start":
+		return service.Start()
+	case "stop":
+		return service.Stop()
+	case "status":
+		return service.Status()
+	case "":
+		// fall through to run the daemon
+	default:
+		return usage, nil
 	}
 
-	stdlog.Println("Starting daemon:", path.Base(os.Args[0]))
+	log.Info("Starting daemon: %s", path.Base(os.Args[0]))
 
-	// read the configuration
-	file, err := os.Open("/etc/" + path.Base(os.Args[0]) + ".json")
+	// read the configuration: defaults < config file < environment < flags
+	configPath := *configPathFlag
+	conf, err := config.Load(configPath)
 	if err != nil {
-		return "Could not open configuration file", err
+		return "Could not read configuration file", err
 	}
-	jsondec := json.NewDecoder(file)
-	config := config.Configuration{}
-	err = jsondec.Decode(&config)
-	if err != nil {
-		return "Could not decode configuration file", err
+	// LOG_LEVEL predates the generic CONFIGURATION_* reflection override
+	// and is kept as an explicit alias so existing deployments that set
+	// it don't silently lose their log level.
+	if envval := os.Getenv("LOG_LEVEL"); len(envval) > 0 {
+		conf.LogLevel = envval
 	}
-
-	if config.FlushSize == 0 {
-		config.FlushSize = 1000
+	config.ApplyEnvOverrides(&conf)
+	config.ApplyEnvOverrides(&conf.Backend)
+	flags.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "interval":
+			conf.Interval = *intervalFlag
+		case "flush-size":
+			conf.FlushSize = *flushSizeFlag
+		case "log-level":
+			conf.LogLevel = *logLevelFlag
+		case "http-listen":
+			conf.HTTPListen = *httpListenFlag
+		}
+	})
+	if len(vcenterFlags) > 0 {
+		vcenters, err := vcenterFlags.VCenters()
+		if err != nil {
+			return "Invalid --vcenter flag", err
+		}
+		conf.VCenters = vcenters
 	}
 
-	if config.Profiling {
+	logger.SetLevel(logger.ParseLevel(conf.LogLevel))
+	logger.SetFormat(conf.LogFormat)
+	go watchDebugSignal()
+
+	if conf.Profiling {
 		f, err := ioutil.TempFile("/tmp", "vsphere-graphite-cpu.profile")
-		stdlog.Println("Will write cpu profiling to: ", f.Name())
 		if err != nil {
-			log.Fatal("could not create CPU profile: ", err)
+			log.Fatal("could not create CPU profile: %s", err)
 		}
+		log.Info("Will write cpu profiling to: %s", f.Name())
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal("could not start CPU profile: ", err)
+			log.Fatal("could not start CPU profile: %s", err)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
-	//force backend values to environement varialbles if present
-	s := reflect.ValueOf(&config.Backend).Elem()
-	numfields := s.NumField()
-	for i := 0; i < numfields; i++ {
-		f := s.Field(i)
-		if f.CanSet() {
-			//exported field
-			envname := strings.ToUpper(s.Type().Name() + "_" + s.Type().Field(i).Name)
-			envval := os.Getenv(envname)
-			if len(envval) > 0 {
-				//environment variable set with name
-				switch ftype := f.Type().Name(); ftype {
-				case "string":
-					f.SetString(envval)
-				case "int":
-					val, err := strconv.ParseInt(envval, 10, 64)
-					if err == nil {
-						f.SetInt(val)
-					}
-				}
-			}
-		}
-	}
-
-	for _, vcenter := range config.VCenters {
-		vcenter.Init(config.Metrics, stdlog, errlog)
+	for _, vcenter := range conf.VCenters {
+		vcenter.Init(conf.Metrics)
 	}
 
-	err = config.Backend.Init(stdlog, errlog)
+	err = conf.Backend.Init()
 	if err != nil {
 		return "Could not initialize backend", err
 	}
-	defer config.Backend.Disconnect()
 
-	// Set up channel on which to send signal notifications.
+	varVersion.Set(version)
+	varStartTime.Set(time.Now().Format(time.RFC3339))
+	if conf.HTTPListen != "" {
+		log.Info("Serving expvar and pprof on %s", conf.HTTPListen)
+		go func() {
+			if err := http.ListenAndServe(conf.HTTPListen, nil); err != nil {
+				log.Error("http listener on %s stopped: %s", conf.HTTPListen, err)
+			}
+		}()
+	}
+
+	// Set up channel on which to send shutdown signal notifications.
 	// We must use a buffered channel or risk missing the signal
 	// if we're not ready to receive when the signal is sent.
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
 
+	// Set up a channel to receive a configuration reload request.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// Context cancelled on shutdown to abort in-flight vCenter queries.
+	ctx, cancel := context.WithCancel(context.Background())
+
 	// Set up a channel to receive the metrics
-	metrics := make(chan backend.Point, config.FlushSize)
+	metrics := make(chan backend.Point, conf.FlushSize)
 
 	// Set up a ticker to collect metrics at givent interval
-	ticker := time.NewTicker(time.Second * time.Duration(config.Interval))
+	ticker := time.NewTicker(time.Second * time.Duration(conf.Interval))
 	defer ticker.Stop()
 
 	// Set up a ticker to garbadge collect
-	memtimer := time.NewTicker(time.Second * time.Duration(config.Interval))
+	memtimer := time.NewTicker(time.Second * time.Duration(conf.Interval))
 	defer memtimer.Stop()
 
 	// Start retriveing and sending metrics
-	stdlog.Println("Retrieving metrics")
-	for _, vcenter := range config.VCenters {
-		go queryVCenter(*vcenter, config, &metrics)
+	log.Info("Retrieving metrics")
+	for _, vcenter := range conf.VCenters {
+		go queryVCenter(ctx, *vcenter, conf, &metrics)
 	}
 
 	// Memory statisctics
 	var memstats runtime.MemStats
 
 	// buffer for points to send
-	pointbuffer := make([]backend.Point, config.FlushSize)
+	pointbuffer := make([]backend.Point, conf.FlushSize)
 	bufferindex := 0
 
 	for {
 		select {
 		case value := <-metrics:
+			if bufferindex >= len(pointbuffer) {
+				varDroppedPoints.Add(1)
+				continue
+			}
 			pointbuffer[bufferindex] = value
 			bufferindex++
+			varBufferFill.Set(int64(bufferindex))
 			if bufferindex == len(pointbuffer) {
-				config.Backend.SendMetrics(pointbuffer)
-				stdlog.Printf("Sent %d logs to backend", len(pointbuffer))
+				if err := conf.Backend.SendMetrics(pointbuffer); err != nil {
+					varSendErrors.Add(1)
+					log.Error("could not send metrics to backend: %s", err)
+				} else {
+					log.Info("Sent %d logs to backend", len(pointbuffer))
+				}
+				varSendCount.Add(1)
+				varLastFlushEpoch.Set(time.Now().Unix())
 				for i := 0; i < len(pointbuffer); i++ {
 					pointbuffer[i] = backend.Point{}
 				}
 				bufferindex = 0
+				varBufferFill.Set(0)
 			}
 		case <-ticker.C:
-			stdlog.Println("Retrieving metrics")
-			for _, vcenter := range config.VCenters {
-				go queryVCenter(*vcenter, config, &metrics)
+			log.Info("Retrieving metrics")
+			for _, vcenter := range conf.VCenters {
+				go queryVCenter(ctx, *vcenter, conf, &metrics)
 			}
 		case <-memtimer.C:
 			runtime.GC()
 			runtime.ReadMemStats(&memstats)
-			stdlog.Println("Memory usage :", bytefmt.ByteSize(memstats.Sys))
-		case killSignal := <-interrupt:
-			stdlog.Println("Got signal:", killSignal)
-			if bufferindex > 0 {
-				config.Backend.SendMetrics(pointbuffer[:bufferindex])
-				stdlog.Printf("Sent %d logs to backend", bufferindex)
+			log.Debug("Memory usage : %s", bytefmt.ByteSize(memstats.Sys))
+		case <-reload:
+			log.Info("SIGHUP received: reloading configuration")
+			backendChanged, err := conf.Reload(configPath)
+			if err != nil {
+				log.Error("could not reload configuration: %s", err)
+				continue
+			}
+			for _, vcenter := range conf.VCenters {
+				vcenter.Init(conf.Metrics)
+			}
+			ticker.Reset(time.Second * time.Duration(conf.Interval))
+			memtimer.Reset(time.Second * time.Duration(conf.Interval))
+			if conf.FlushSize != len(pointbuffer) {
+				log.Info("Resizing point buffer from %d to %d after reload", len(pointbuffer), conf.FlushSize)
+				pointbuffer = make([]backend.Point, conf.FlushSize)
+				bufferindex = 0
+				varBufferFill.Set(0)
 			}
-			if killSignal == os.Interrupt {
-				return "Daemon was interrupted by system signal", nil
+			if backendChanged {
+				log.Info("Backend configuration changed and reinitialized")
 			}
-			return "Daemon was killed", nil
+			log.Info("Configuration reloaded")
+		case killSignal := <-interrupt:
+			log.Info("Got signal: %v", killSignal)
+			ticker.Stop()
+			memtimer.Stop()
+			return drain(&conf, cancel, pointbuffer, bufferindex, interrupt)
 		}
 	}
 }
 
-func init() {
-	stdlog = log.New(os.Stdout, "", log.Ldate|log.Ltime)
-	errlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
-}
-
 func main() {
 	srv, err := daemon.New(name, description, dependencies...)
 	if err != nil {
-		errlog.Println("Error: ", err)
+		log.Error("Error: %s", err)
 		os.Exit(1)
 	}
 	service := &Service{srv}
 	status, err := service.Manage()
 	if err != nil {
-		errlog.Println(status, "Error: ", err)
+		log.Error("%s Error: %s", status, err)
 		os.Exit(1)
 	}
 	fmt.Println(status)
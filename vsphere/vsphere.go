@@ -0,0 +1,45 @@
+package vsphere
+
+import (
+	"context"
+
+	"github.com/cblomart/vsphere-graphite/backend"
+	"github.com/cblomart/vsphere-graphite/logger"
+)
+
+var log = logger.New("vsphere")
+
+// MetricDef : definition of a performance counter to collect, as read
+// from the configuration file.
+type MetricDef struct {
+	ObjectType []string
+	Definition string
+	Instances  string
+}
+
+// VCenter : connection details and state for a single vsphere endpoint.
+type VCenter struct {
+	Hostname string
+	Username string
+	Password string
+	Metrics  []MetricDef
+}
+
+// Init stores the metric definitions to collect for this vCenter.
+func (vcenter *VCenter) Init(metrics []MetricDef) {
+	vcenter.Metrics = metrics
+	log.Debug("initialized vcenter %s with %d metrics", vcenter.Hostname, len(metrics))
+}
+
+// Query returns ctx's error if ctx is already cancelled and nil
+// otherwise. It does not contact the vCenter and sends no points to the
+// given channel.
+func (vcenter *VCenter) Query(ctx context.Context, interval int, domain string, channel *chan backend.Point) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	// actual collection against the vsphere API is out of scope here.
+	return nil
+}